@@ -0,0 +1,261 @@
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipMagic and zstdMagic are the magic byte sequences a chunk's compressed
+// range begins with when it is a self-contained gzip member or zstd frame
+// respectively. Both formats, used by zstd:chunked and eStargz layers,
+// align chunk boundaries so each chunk decompresses independently.
+var (
+	gzipMagic = []byte{0x1F, 0x8B, 0x08}
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+)
+
+// CompressionDetector sniffs the leading bytes of a chunk stream to decide
+// which decompressor, if any, to wrap it with. The zero value has no
+// registered formats; use [DefaultCompressionDetector] or [NewCompressionDetector]
+// to get one preloaded with gzip and zstd.
+type CompressionDetector struct {
+	mu      sync.RWMutex
+	formats []compressionFormat
+}
+
+type compressionFormat struct {
+	name  string
+	magic []byte
+	wrap  func(io.Reader) (io.ReadCloser, error)
+}
+
+// NewCompressionDetector returns a CompressionDetector preloaded with gzip
+// and zstd, the formats zstd:chunked and eStargz layers use.
+func NewCompressionDetector() *CompressionDetector {
+	d := &CompressionDetector{}
+	d.Register("gzip", gzipMagic, func(r io.Reader) (io.ReadCloser, error) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open gzip chunk: %w", err)
+		}
+		return gz, nil
+	})
+	d.Register("zstd", zstdMagic, func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open zstd chunk: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	})
+	return d
+}
+
+// DefaultCompressionDetector is used whenever a [SeekableOptions] doesn't
+// specify one of its own.
+var DefaultCompressionDetector = NewCompressionDetector()
+
+// Register adds, or replaces, the decompressor used for chunks whose first
+// len(magic) bytes equal magic. Longer magics are matched before shorter
+// ones, so a caller can register a more specific variant of an already
+// registered format without it being shadowed.
+func (d *CompressionDetector) Register(name string, magic []byte, wrap func(io.Reader) (io.ReadCloser, error)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, f := range d.formats {
+		if f.name == name {
+			d.formats[i] = compressionFormat{name: name, magic: magic, wrap: wrap}
+			return
+		}
+	}
+	d.formats = append(d.formats, compressionFormat{name: name, magic: magic, wrap: wrap})
+}
+
+// detect returns the registered format matching header's prefix, or "" if
+// none match and the content should be treated as already-plaintext.
+func (d *CompressionDetector) detect(header []byte) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	best := ""
+	bestLen := 0
+	for _, f := range d.formats {
+		if len(f.magic) > bestLen && len(header) >= len(f.magic) && bytes.Equal(header[:len(f.magic)], f.magic) {
+			best = f.name
+			bestLen = len(f.magic)
+		}
+	}
+	return best
+}
+
+// decompress peeks at r's leading bytes, picks the matching registered
+// format (if any), and returns an io.ReadCloser of the decompressed
+// content. r is consumed by, and closed through, the returned reader's
+// Close; if decompress returns an error, r is closed before it returns.
+func (d *CompressionDetector) decompress(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, 4)
+	header, _ := br.Peek(4)
+
+	name := d.detect(header)
+	if name == "" {
+		return &readCloser{Reader: br, closer: r}, nil
+	}
+
+	d.mu.RLock()
+	var wrap func(io.Reader) (io.ReadCloser, error)
+	for _, f := range d.formats {
+		if f.name == name {
+			wrap = f.wrap
+			break
+		}
+	}
+	d.mu.RUnlock()
+
+	decompressed, err := wrap(br)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: decompressed, closer: multiCloser{decompressed, r}}, nil
+}
+
+// readCloser pairs an io.Reader with a separate io.Closer.
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (c *readCloser) Close() error {
+	return c.closer.Close()
+}
+
+// multiCloser closes every underlying closer, in order, returning the
+// first error encountered.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SeekableOptions configures a seekableFile created by newSeekableFile,
+// which uses Detector, and a [PrefetchChunks] call, which uses
+// PrefetchWorkers and Store.
+type SeekableOptions struct {
+	// Detector picks the decompressor applied to each chunk GetBlobAt
+	// returns. A nil Detector uses DefaultCompressionDetector.
+	Detector *CompressionDetector
+
+	// PrefetchWorkers is the worker pool size [PrefetchChunks] uses to
+	// pipeline chunk fetch+decompress+verify ahead of the differ consuming
+	// them. <=1 fetches one chunk at a time.
+	PrefetchWorkers int
+
+	// Store, if non-nil, is checked before, and populated after, fetching
+	// each chunk from the image source, the same way DedupPolicy.Store is
+	// used by copyFileContent.
+	Store ChunkStore
+}
+
+// ChunkRequest is one chunk to fetch with [PrefetchChunks]: the byte range
+// to request from the image source, and the TOC digest its plaintext
+// content is expected to hash to.
+type ChunkRequest struct {
+	Chunk  ImageSourceChunk
+	Digest string
+}
+
+// PrefetchChunks fetches, decompresses (via source's own GetBlobAt, which
+// for a seekableFile applies that file's own SeekableOptions.Detector;
+// opts.Detector is not used here) and digest-verifies every chunk in requests,
+// using a pool of opts.PrefetchWorkers goroutines so the caller isn't
+// serialized on one chunk's network latency before starting the next.
+// Results are returned in the same order as requests.
+func PrefetchChunks(source ImageSourceSeekable, requests []ChunkRequest, opts SeekableOptions) ([][]byte, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	workers := opts.PrefetchWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(requests) {
+		workers = len(requests)
+	}
+
+	results := make([][]byte, len(requests))
+	errs := make([]error, len(requests))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = fetchAndVerifyChunk(source, requests[i], opts.Store)
+			}
+		}()
+	}
+	for i := range requests {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("prefetch chunk %d (digest %q): %w", i, requests[i].Digest, err)
+		}
+	}
+	return results, nil
+}
+
+// fetchAndVerifyChunk fetches and verifies a single chunk, reusing store if
+// it already has a copy.
+func fetchAndVerifyChunk(source ImageSourceSeekable, req ChunkRequest, store ChunkStore) ([]byte, error) {
+	if store != nil && req.Digest != "" {
+		if content, err := readChunkFromStore(store, req.Digest); err == nil {
+			return content, nil
+		}
+	}
+
+	streams, errCh, err := source.GetBlobAt([]ImageSourceChunk{req.Chunk})
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	for stream := range streams {
+		content, err = io.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	if req.Digest != "" {
+		if err := verifyDigest(req.Digest, content); err != nil {
+			return nil, err
+		}
+		if store != nil {
+			insertChunkIntoStore(store, req.Digest, content)
+		}
+	}
+	return content, nil
+}
@@ -0,0 +1,124 @@
+package chunked
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type fakeReaderAtCloser struct {
+	*bytes.Reader
+}
+
+func (fakeReaderAtCloser) Close() error { return nil }
+
+// TestSeekableFileGetBlobAtClosesStreamsBeforeError is a regression test
+// for a deadlock where the fetch goroutine sent on errs, with streams still
+// open, while every consumer drains streams to completion before ever
+// reading errs.
+func TestSeekableFileGetBlobAtClosesStreamsBeforeError(t *testing.T) {
+	// Valid gzip magic, invalid gzip member: fails inside detector.decompress.
+	data := []byte{0x1F, 0x8B, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00}
+	f := newSeekableFile(fakeReaderAtCloser{bytes.NewReader(data)}, SeekableOptions{})
+
+	streams, errs, err := f.GetBlobAt([]ImageSourceChunk{{Offset: 0, Length: uint64(len(data))}})
+	if err != nil {
+		t.Fatalf("GetBlobAt: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for range streams {
+		}
+		done <- <-errs
+	}()
+
+	select {
+	case gotErr := <-done:
+		if gotErr == nil {
+			t.Fatal("expected a decompression error, got nil")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("GetBlobAt deadlocked: streams was not closed before the error became available on errs")
+	}
+}
+
+// buildChunkFixture concatenates contents into one blob and returns the
+// ImageSourceChunk byte ranges and digests locating each piece within it, in
+// the same order as contents.
+func buildChunkFixture(contents [][]byte) ([]byte, []ImageSourceChunk, []string) {
+	var blob bytes.Buffer
+	chunks := make([]ImageSourceChunk, len(contents))
+	digests := make([]string, len(contents))
+	for i, c := range contents {
+		chunks[i] = ImageSourceChunk{Offset: uint64(blob.Len()), Length: uint64(len(c))}
+		digests[i] = digest.FromBytes(c).String()
+		blob.Write(c)
+	}
+	return blob.Bytes(), chunks, digests
+}
+
+// TestPrefetchChunksOrdersResults is a regression test for PrefetchChunks'
+// worker pool: with PrefetchWorkers > 1, chunks complete out of order, but
+// results must still come back indexed by request order, not completion
+// order.
+func TestPrefetchChunksOrdersResults(t *testing.T) {
+	contents := [][]byte{
+		[]byte("chunk-zero"),
+		[]byte("chunk-one"),
+		[]byte("chunk-two"),
+		[]byte("chunk-three"),
+	}
+	blob, chunks, digests := buildChunkFixture(contents)
+	source := newSeekableFile(fakeReaderAtCloser{bytes.NewReader(blob)}, SeekableOptions{})
+
+	requests := make([]ChunkRequest, len(contents))
+	for i := range contents {
+		requests[i] = ChunkRequest{Chunk: chunks[i], Digest: digests[i]}
+	}
+
+	results, err := PrefetchChunks(source, requests, SeekableOptions{PrefetchWorkers: 4})
+	if err != nil {
+		t.Fatalf("PrefetchChunks: %v", err)
+	}
+	for i, want := range contents {
+		if !bytes.Equal(results[i], want) {
+			t.Errorf("results[%d] = %q, want %q", i, results[i], want)
+		}
+	}
+}
+
+// TestPrefetchChunksIsolatesOneBadDigest is a regression test for
+// PrefetchChunks' worker pool: a single chunk's digest mismatch must
+// surface as an error attributing the failing request's own index and
+// digest, not one of the other, unrelated, concurrently-fetched chunks.
+func TestPrefetchChunksIsolatesOneBadDigest(t *testing.T) {
+	contents := [][]byte{
+		[]byte("chunk-zero"),
+		[]byte("chunk-one"),
+		[]byte("chunk-two"),
+		[]byte("chunk-three"),
+	}
+	const badIndex = 2
+	blob, chunks, digests := buildChunkFixture(contents)
+	source := newSeekableFile(fakeReaderAtCloser{bytes.NewReader(blob)}, SeekableOptions{})
+
+	requests := make([]ChunkRequest, len(contents))
+	for i := range contents {
+		requests[i] = ChunkRequest{Chunk: chunks[i], Digest: digests[i]}
+	}
+	requests[badIndex].Digest = digest.FromBytes([]byte("not the real content")).String()
+
+	_, err := PrefetchChunks(source, requests, SeekableOptions{PrefetchWorkers: 4})
+	if err == nil {
+		t.Fatal("PrefetchChunks: expected an error from the mismatched digest, got nil")
+	}
+	want := fmt.Sprintf("prefetch chunk %d (digest %q)", badIndex, requests[badIndex].Digest)
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("PrefetchChunks error = %q, want it to contain %q", err.Error(), want)
+	}
+}
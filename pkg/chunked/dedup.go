@@ -0,0 +1,72 @@
+package chunked
+
+import (
+	"fmt"
+	"os"
+)
+
+// ChunkStore is a content-addressed store of already-materialized chunk
+// content, keyed by the TOC digest of the chunk.  It lets the chunked differ
+// reuse bytes that were already extracted for a previous layer or image
+// instead of re-downloading and re-decompressing them.
+type ChunkStore interface {
+	// Lookup returns an open, readable fd for the chunk stored under digest
+	// along with its size.  It returns an error (commonly one satisfying
+	// os.IsNotExist) if digest is not present in the store.
+	Lookup(digest string) (fd int, size int64, err error)
+
+	// Insert adds the content read from fd to the store under digest.  fd
+	// is owned by the caller; Insert must not close it.
+	Insert(digest string, fd int) error
+}
+
+// DedupPolicy controls how copyFileContent tries to avoid writing bytes that
+// are already available somewhere on the destination filesystem or in a
+// ChunkStore.  It replaces the previous bare useHardLinks boolean with a
+// policy that also covers cross-layer reflink/store-backed deduplication.
+type DedupPolicy struct {
+	// UseHardLinks enables the existing same-layer, same-device hard link
+	// deduplication: if the same source fd was already materialized under
+	// this checkout, link to it instead of copying again.
+	UseHardLinks bool
+
+	// Store, if non-nil, is consulted by digest before any bytes are
+	// written: on a hit, the chunk is reflinked (FICLONERANGE), hard
+	// linked, or copied with copy_file_range from the stored copy; on a
+	// miss, the materialized file is inserted into the store keyed by
+	// digest so later layers/images can reuse it.
+	Store ChunkStore
+}
+
+// lookupAndLink tries to satisfy destFile from p.Store under digest, in order
+// of preference: reflink, hard link, copy_file_range.  It reports whether the
+// content was materialized from the store.
+func (p DedupPolicy) lookupAndLink(digest string, destDirFd int, destBase string, destFile string) (bool, int64, error) {
+	if p.Store == nil || digest == "" {
+		return false, 0, nil
+	}
+
+	srcFd, size, err := p.Store.Lookup(digest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, 0, nil
+		}
+		return false, 0, fmt.Errorf("look up digest %q in chunk store: %w", digest, err)
+	}
+	defer unixClose(srcFd)
+
+	if err := reflinkOrCopy(srcFd, destDirFd, destBase, size); err != nil {
+		return false, 0, fmt.Errorf("materialize %q from chunk store: %w", destFile, err)
+	}
+	return true, size, nil
+}
+
+// insert stores the content at srcFd under digest in p.Store, if configured.
+// Failures to populate the store are not fatal to the file being written; the
+// caller should log and continue.
+func (p DedupPolicy) insert(digest string, srcFd int) error {
+	if p.Store == nil || digest == "" {
+		return nil
+	}
+	return p.Store.Insert(digest, srcFd)
+}
@@ -0,0 +1,111 @@
+package chunked
+
+import (
+	"errors"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+)
+
+// Sentinel errors returned (wrapped with %w, alongside syscall-level
+// context) by this package's file-apply, path-resolution and chunk-fetch
+// helpers. Callers, and
+// ErrorPolicy implementations in particular, can tell one class of
+// extraction failure from another with errors.Is instead of parsing error
+// strings.
+var (
+	// ErrChownDenied is returned when chown(2)/fchownat(2) fails, commonly
+	// because the caller lacks CAP_CHOWN or a usable subuid/subgid mapping
+	// for the requested owner.
+	ErrChownDenied = errors.New("chown denied")
+
+	// ErrXattrUnsupported is returned when setting an extended attribute
+	// fails for a reason other than the filesystem not supporting xattrs
+	// at all (that case is already tolerated unconditionally).
+	ErrXattrUnsupported = errors.New("xattr could not be set")
+
+	// ErrPathEscape is returned by the userspace fallback resolver when a
+	// TOC entry's name or link target resolves outside of the root
+	// directory it is being extracted under. openat2(2) never returns it:
+	// with RESOLVE_IN_ROOT such a path resolves inside the root, and with
+	// RESOLVE_BENEATH the kernel fails it with its own errno.
+	ErrPathEscape = errors.New("path escapes extraction root")
+
+	// ErrChunkDigestMismatch is returned when a chunk's fetched content
+	// does not hash to the digest recorded for it in the TOC.
+	ErrChunkDigestMismatch = errors.New("chunk content does not match TOC digest")
+
+	// ErrHardlinkCrossDevice is returned when a hard link's source and
+	// destination resolve to different devices, which link(2) cannot
+	// span.
+	ErrHardlinkCrossDevice = errors.New("hard link target is on a different device")
+)
+
+// ErrorAction tells the differ how to proceed after an ErrorPolicy has
+// looked at a failure applying one file's metadata or content.
+type ErrorAction int
+
+const (
+	// ErrorActionAbort aborts the whole layer apply. This is the zero
+	// value and the behavior when no ErrorPolicy is configured, matching
+	// the package's historical all-or-nothing behavior.
+	ErrorActionAbort ErrorAction = iota
+
+	// ErrorActionSkip abandons the rest of the entry - inside setFileAttrs,
+	// no further attributes are applied to it - and moves on to the next
+	// one. Whatever was already applied before the failing step (e.g. the
+	// file's content, if the failure is in an attribute set afterwards) is
+	// left in place. An error looking a file up in DedupPolicy.Store is the
+	// exception: for it, copyFileContent treats ErrorActionSkip like
+	// ErrorActionRetryWithoutAttr, ignores the store and writes the file's
+	// content the normal way.
+	ErrorActionSkip
+
+	// ErrorActionRetryWithoutAttr abandons only the attribute that failed
+	// and continues applying the rest of the entry's metadata, e.g.
+	// keeping a file's mode and timestamps intact even though its
+	// ownership or an xattr couldn't be applied. Outside setFileAttrs -
+	// safeMkdir's own mkdir and safeLink's own hard link have no
+	// finer-grained attribute to drop, so it behaves the same as
+	// ErrorActionSkip there.
+	ErrorActionRetryWithoutAttr
+)
+
+// ErrorPolicy, when set on the differ's options, is consulted for errors of
+// the individual apply steps - creating a directory or hard link, copying or
+// deduplicating a file's content, and setting its ownership, xattrs, times
+// and mode - that would otherwise abort the layer apply. Errors opening or
+// resolving paths under the root, and errors creating symlinks, are
+// returned without consulting it. It receives the TOC
+// entry being processed and the error that occurred, and decides whether
+// to abort, skip the entry, or retry without the failing attribute.
+//
+// entry is the same *internal.FileMetadata that drives TOC parsing, so an
+// ErrorPolicy can report skipped entries back to its caller at the
+// granularity podman rootless and fs-gofer-style translators need, well
+// beyond the current all-or-nothing IgnoreChownErrors.
+type ErrorPolicy func(entry *internal.FileMetadata, err error) ErrorAction
+
+// consultErrorPolicy runs policy, if any, over err and metadata, returning
+// ErrorActionAbort when policy is nil so callers that don't set one keep
+// the historical always-abort behavior.
+func consultErrorPolicy(policy ErrorPolicy, metadata *fileMetadata, err error) ErrorAction {
+	if policy == nil {
+		return ErrorActionAbort
+	}
+	return policy(&metadata.FileMetadata, err)
+}
+
+// attrErrorOutcome is consultErrorPolicy applied to a single attribute
+// (chown, one xattr, utimes, chmod) inside setFileAttrs: it reports whether
+// to abort entirely, abandon the rest of the entry's attributes (skip), or
+// leave just this attribute unset and keep going (retry without it).
+func attrErrorOutcome(policy ErrorPolicy, metadata *fileMetadata, err error) (abort, skipRest bool) {
+	switch consultErrorPolicy(policy, metadata, err) {
+	case ErrorActionAbort:
+		return true, false
+	case ErrorActionSkip:
+		return false, true
+	default: // ErrorActionRetryWithoutAttr
+		return false, false
+	}
+}
@@ -7,15 +7,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync/atomic"
 	"syscall"
 	"time"
 
 	driversCopy "github.com/containers/storage/drivers/copy"
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/chunked/internal"
-	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/vbatts/tar-split/archive/tar"
 	"golang.org/x/sys/unix"
 )
@@ -61,13 +58,57 @@ func doHardLink(srcFd int, destDirFd int, destBase string) error {
 	// if the destination exists, unlink it first and try again
 	if err != nil && os.IsExist(err) {
 		unix.Unlinkat(destDirFd, destBase, 0)
-		return doLink()
+		err = doLink()
+	}
+	if errors.Is(err, unix.EXDEV) {
+		return fmt.Errorf("%w: %w", ErrHardlinkCrossDevice, err)
 	}
 	return err
 }
 
-func copyFileContent(srcFd int, fileMetadata *fileMetadata, dirfd int, mode os.FileMode, useHardLinks bool) (*os.File, int64, error) {
+// copyFileContent materializes fileMetadata's content under dirfd, in order
+// of preference: policy.Store looked up by the file's TOC digest (a hit is
+// reflinked, hard linked, or copied with copy_file_range from the stored
+// copy), this layer's own same-device hard link dedup (policy.UseHardLinks),
+// and finally a plain copy. Content written by the plain copy is inserted
+// into policy.Store so later layers/images can reuse it. openSrc is called
+// at most once, and only when the policy.Store lookup, if any, has not
+// satisfied destFile, so a policy.Store hit never pays for fetching or
+// decompressing content that's already on disk somewhere; the hard link
+// dedup needs the fd openSrc returns. It must return an
+// fd open for reading the file's plaintext content; copyFileContent closes
+// it before returning.
+func copyFileContent(resolver *PathResolver, openSrc func() (int, error), fileMetadata *fileMetadata, dirfd int, mode os.FileMode, policy DedupPolicy, errPolicy ErrorPolicy) (*os.File, int64, error) {
 	destFile := fileMetadata.Name
+	destDirPath, destBase := filepath.Split(destFile)
+
+	digest := fileMetadata.Digest
+	if policy.Store != nil && digest != "" {
+		destDir, err := resolver.openFileUnderRoot(dirfd, destDirPath, 0, 0)
+		if err == nil {
+			ok, size, lerr := policy.lookupAndLink(digest, int(destDir.Fd()), destBase, destFile)
+			destDir.Close()
+			if lerr != nil {
+				if consultErrorPolicy(errPolicy, fileMetadata, lerr) == ErrorActionAbort {
+					return nil, -1, lerr
+				}
+				// Skip or retry-without-attr: a dedup-store hiccup isn't
+				// fatal, fall through and materialize destFile the normal
+				// way instead.
+			} else if ok {
+				// if the file was deduplicated from the chunk store, skip overriding file metadata.
+				fileMetadata.skipSetAttrs = true
+				return nil, size, nil
+			}
+		}
+	}
+
+	srcFd, err := openSrc()
+	if err != nil {
+		return nil, -1, fmt.Errorf("fetch content for %q: %w", destFile, err)
+	}
+	defer unixClose(srcFd)
+
 	src := procPathForFd(srcFd)
 	st, err := os.Stat(src)
 	if err != nil {
@@ -76,9 +117,8 @@ func copyFileContent(srcFd int, fileMetadata *fileMetadata, dirfd int, mode os.F
 
 	copyWithFileRange, copyWithFileClone := true, true
 
-	if useHardLinks {
-		destDirPath, destBase := filepath.Split(destFile)
-		destDir, err := openFileUnderRoot(dirfd, destDirPath, 0, 0)
+	if policy.UseHardLinks {
+		destDir, err := resolver.openFileUnderRoot(dirfd, destDirPath, 0, 0)
 		if err == nil {
 			defer destDir.Close()
 
@@ -92,7 +132,7 @@ func copyFileContent(srcFd int, fileMetadata *fileMetadata, dirfd int, mode os.F
 	}
 
 	// If the destination file already exists, we shouldn't blow it away
-	dstFile, err := openFileUnderRoot(dirfd, destFile, newFileFlags, mode)
+	dstFile, err := resolver.openFileUnderRoot(dirfd, destFile, newFileFlags, mode)
 	if err != nil {
 		return nil, -1, fmt.Errorf("open file %q under rootfs for copy: %w", destFile, err)
 	}
@@ -100,8 +140,22 @@ func copyFileContent(srcFd int, fileMetadata *fileMetadata, dirfd int, mode os.F
 	err = driversCopy.CopyRegularToFile(src, dstFile, st, &copyWithFileRange, &copyWithFileClone)
 	if err != nil {
 		dstFile.Close()
-		return nil, -1, fmt.Errorf("copy to file %q under rootfs: %w", destFile, err)
+		wrapped := fmt.Errorf("copy to file %q under rootfs: %w", destFile, err)
+		if consultErrorPolicy(errPolicy, fileMetadata, wrapped) == ErrorActionAbort {
+			return nil, -1, wrapped
+		}
+		// Leave no partial file behind for a skipped entry.
+		if destDir, derr := resolver.openFileUnderRoot(dirfd, destDirPath, 0, 0); derr == nil {
+			unix.Unlinkat(int(destDir.Fd()), destBase, 0)
+			destDir.Close()
+		}
+		return nil, 0, nil
 	}
+
+	// Best-effort: a failure to populate the chunk store doesn't affect the
+	// file that was just materialized on disk.
+	_ = policy.insert(digest, int(dstFile.Fd()))
+
 	return dstFile, st.Size(), nil
 }
 
@@ -115,8 +169,13 @@ func timeToTimespec(time *time.Time) (ts unix.Timespec) {
 	return unix.NsecToTimespec(time.UnixNano())
 }
 
-// setFileAttrs sets the file attributes for file given metadata
-func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *fileMetadata, options *archive.TarOptions, usePath bool) error {
+// setFileAttrs sets the file attributes for file given metadata. Failures
+// that options.IgnoreChownErrors doesn't already unconditionally tolerate
+// are run past policy before being treated as fatal: instead of aborting
+// the whole layer apply, ErrorActionRetryWithoutAttr leaves the failing
+// attribute unset and moves on to the next one, and ErrorActionSkip leaves
+// the failing attribute and every later one of the entry unset.
+func setFileAttrs(resolver *PathResolver, dirfd int, file *os.File, mode os.FileMode, metadata *fileMetadata, options *archive.TarOptions, usePath bool, policy ErrorPolicy) error {
 	if metadata.skipSetAttrs {
 		return nil
 	}
@@ -139,7 +198,7 @@ func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *fileMeta
 	if usePath {
 		dirName := filepath.Dir(metadata.Name)
 		if dirName != "" {
-			parentFd, err := openFileUnderRoot(dirfd, dirName, unix.O_PATH|unix.O_DIRECTORY, 0)
+			parentFd, err := resolver.openFileUnderRoot(dirfd, dirName, unix.O_PATH|unix.O_DIRECTORY, 0)
 			if err != nil {
 				return err
 			}
@@ -178,7 +237,14 @@ func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *fileMeta
 
 	if err := doChown(); err != nil {
 		if !options.IgnoreChownErrors {
-			return fmt.Errorf("chown %q to %d:%d: %w", metadata.Name, metadata.UID, metadata.GID, err)
+			wrapped := fmt.Errorf("%w: chown %q to %d:%d: %w", ErrChownDenied, metadata.Name, metadata.UID, metadata.GID, err)
+			abort, skipRest := attrErrorOutcome(policy, metadata, wrapped)
+			if abort {
+				return wrapped
+			}
+			if skipRest {
+				return nil
+			}
 		}
 	}
 
@@ -192,177 +258,46 @@ func setFileAttrs(dirfd int, file *os.File, mode os.FileMode, metadata *fileMeta
 		}
 		data, err := base64.StdEncoding.DecodeString(v)
 		if err != nil {
-			return fmt.Errorf("decode xattr %q: %w", v, err)
+			wrapped := fmt.Errorf("decode xattr %q: %w", v, err)
+			abort, skipRest := attrErrorOutcome(policy, metadata, wrapped)
+			if abort {
+				return wrapped
+			}
+			if skipRest {
+				return nil
+			}
+			continue
 		}
 		if err := doSetXattr(k, data); !canIgnore(err) {
-			return fmt.Errorf("set xattr %s=%q for %q: %w", k, data, metadata.Name, err)
-		}
-	}
-
-	if err := doUtimes(); !canIgnore(err) {
-		return fmt.Errorf("set utimes for %q: %w", metadata.Name, err)
-	}
-
-	if err := doChmod(); !canIgnore(err) {
-		return fmt.Errorf("chmod %q: %w", metadata.Name, err)
-	}
-	return nil
-}
-
-func openFileUnderRootFallback(dirfd int, name string, flags uint64, mode os.FileMode) (int, error) {
-	root := procPathForFd(dirfd)
-
-	targetRoot, err := os.Readlink(root)
-	if err != nil {
-		return -1, err
-	}
-
-	hasNoFollow := (flags & unix.O_NOFOLLOW) != 0
-
-	var fd int
-	// If O_NOFOLLOW is specified in the flags, then resolve only the parent directory and use the
-	// last component as the path to openat().
-	if hasNoFollow {
-		dirName, baseName := filepath.Split(name)
-		if dirName != "" && dirName != "." {
-			newRoot, err := securejoin.SecureJoin(root, dirName)
-			if err != nil {
-				return -1, err
+			wrapped := fmt.Errorf("%w: set xattr %s=%q for %q: %w", ErrXattrUnsupported, k, data, metadata.Name, err)
+			abort, skipRest := attrErrorOutcome(policy, metadata, wrapped)
+			if abort {
+				return wrapped
+			}
+			if skipRest {
+				return nil
 			}
-			root = newRoot
-		}
-
-		parentDirfd, err := unix.Open(root, unix.O_PATH|unix.O_CLOEXEC, 0)
-		if err != nil {
-			return -1, err
-		}
-		defer unix.Close(parentDirfd)
-
-		fd, err = unix.Openat(parentDirfd, baseName, int(flags), uint32(mode))
-		if err != nil {
-			return -1, err
-		}
-	} else {
-		newPath, err := securejoin.SecureJoin(root, name)
-		if err != nil {
-			return -1, err
-		}
-		fd, err = unix.Openat(dirfd, newPath, int(flags), uint32(mode))
-		if err != nil {
-			return -1, err
 		}
 	}
 
-	target, err := os.Readlink(procPathForFd(fd))
-	if err != nil {
-		unix.Close(fd)
-		return -1, err
-	}
-
-	// Add an additional check to make sure the opened fd is inside the rootfs
-	if !strings.HasPrefix(target, targetRoot) {
-		unix.Close(fd)
-		return -1, fmt.Errorf("while resolving %q.  It resolves outside the root directory", name)
-	}
-
-	return fd, err
-}
-
-func openFileUnderRootOpenat2(dirfd int, name string, flags uint64, mode os.FileMode) (int, error) {
-	how := unix.OpenHow{
-		Flags:   flags,
-		Mode:    uint64(mode & 0o7777),
-		Resolve: unix.RESOLVE_IN_ROOT,
-	}
-	return unix.Openat2(dirfd, name, &how)
-}
-
-// skipOpenat2 is set when openat2 is not supported by the underlying kernel and avoid
-// using it again.
-var skipOpenat2 int32
-
-// openFileUnderRootRaw tries to open a file using openat2 and if it is not supported fallbacks to a
-// userspace lookup.
-func openFileUnderRootRaw(dirfd int, name string, flags uint64, mode os.FileMode) (int, error) {
-	var fd int
-	var err error
-	if name == "" {
-		return unix.Dup(dirfd)
-	}
-	if atomic.LoadInt32(&skipOpenat2) > 0 {
-		fd, err = openFileUnderRootFallback(dirfd, name, flags, mode)
-	} else {
-		fd, err = openFileUnderRootOpenat2(dirfd, name, flags, mode)
-		// If the function failed with ENOSYS, switch off the support for openat2
-		// and fallback to using safejoin.
-		if err != nil && errors.Is(err, unix.ENOSYS) {
-			atomic.StoreInt32(&skipOpenat2, 1)
-			fd, err = openFileUnderRootFallback(dirfd, name, flags, mode)
+	if err := doUtimes(); !canIgnore(err) {
+		wrapped := fmt.Errorf("set utimes for %q: %w", metadata.Name, err)
+		abort, skipRest := attrErrorOutcome(policy, metadata, wrapped)
+		if abort {
+			return wrapped
 		}
-	}
-	return fd, err
-}
-
-// openFileUnderRoot safely opens a file under the specified root directory using openat2
-// dirfd is an open file descriptor to the target checkout directory.
-// name is the path to open relative to dirfd.
-// flags are the flags to pass to the open syscall.
-// mode specifies the mode to use for newly created files.
-func openFileUnderRoot(dirfd int, name string, flags uint64, mode os.FileMode) (*os.File, error) {
-	fd, err := openFileUnderRootRaw(dirfd, name, flags, mode)
-	if err == nil {
-		return os.NewFile(uintptr(fd), name), nil
-	}
-
-	hasCreate := (flags & unix.O_CREAT) != 0
-	if errors.Is(err, unix.ENOENT) && hasCreate {
-		parent := filepath.Dir(name)
-		if parent != "" {
-			newDirfd, err2 := openOrCreateDirUnderRoot(dirfd, parent, 0)
-			if err2 == nil {
-				defer newDirfd.Close()
-				fd, err := openFileUnderRootRaw(int(newDirfd.Fd()), filepath.Base(name), flags, mode)
-				if err == nil {
-					return os.NewFile(uintptr(fd), name), nil
-				}
-			}
+		if skipRest {
+			return nil
 		}
 	}
-	return nil, fmt.Errorf("open %q under the rootfs: %w", name, err)
-}
-
-// openOrCreateDirUnderRoot safely opens a directory or create it if it is missing.
-// dirfd is an open file descriptor to the target checkout directory.
-// name is the path to open relative to dirfd.
-// mode specifies the mode to use for newly created files.
-func openOrCreateDirUnderRoot(dirfd int, name string, mode os.FileMode) (*os.File, error) {
-	fd, err := openFileUnderRootRaw(dirfd, name, unix.O_DIRECTORY|unix.O_RDONLY, 0)
-	if err == nil {
-		return os.NewFile(uintptr(fd), name), nil
-	}
-
-	if errors.Is(err, unix.ENOENT) {
-		parent := filepath.Dir(name)
-		if parent != "" {
-			pDir, err2 := openOrCreateDirUnderRoot(dirfd, parent, mode)
-			if err2 != nil {
-				return nil, err
-			}
-			defer pDir.Close()
-
-			baseName := filepath.Base(name)
-
-			if err2 := unix.Mkdirat(int(pDir.Fd()), baseName, uint32(mode)); err2 != nil {
-				return nil, err
-			}
 
-			fd, err = openFileUnderRootRaw(int(pDir.Fd()), baseName, unix.O_DIRECTORY|unix.O_RDONLY, 0)
-			if err == nil {
-				return os.NewFile(uintptr(fd), name), nil
-			}
+	if err := doChmod(); !canIgnore(err) {
+		wrapped := fmt.Errorf("chmod %q: %w", metadata.Name, err)
+		if consultErrorPolicy(policy, metadata, wrapped) == ErrorActionAbort {
+			return wrapped
 		}
 	}
-	return nil, err
+	return nil
 }
 
 // appendHole creates a hole with the specified size at the open fd.
@@ -378,11 +313,11 @@ func appendHole(fd int, size int64) error {
 	return nil
 }
 
-func safeMkdir(dirfd int, mode os.FileMode, name string, metadata *fileMetadata, options *archive.TarOptions) error {
+func safeMkdir(resolver *PathResolver, dirfd int, mode os.FileMode, name string, metadata *fileMetadata, options *archive.TarOptions, policy ErrorPolicy) error {
 	parent, base := filepath.Split(name)
 	parentFd := dirfd
 	if parent != "" && parent != "." {
-		parentFile, err := openOrCreateDirUnderRoot(dirfd, parent, 0)
+		parentFile, err := resolver.openOrCreateDirUnderRoot(dirfd, parent, 0)
 		if err != nil {
 			return err
 		}
@@ -392,21 +327,25 @@ func safeMkdir(dirfd int, mode os.FileMode, name string, metadata *fileMetadata,
 
 	if err := unix.Mkdirat(parentFd, base, uint32(mode)); err != nil {
 		if !os.IsExist(err) {
-			return fmt.Errorf("mkdir %q: %w", name, err)
+			wrapped := fmt.Errorf("mkdir %q: %w", name, err)
+			if consultErrorPolicy(policy, metadata, wrapped) == ErrorActionAbort {
+				return wrapped
+			}
+			return nil
 		}
 	}
 
-	file, err := openFileUnderRoot(parentFd, base, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	file, err := resolver.openFileUnderRoot(parentFd, base, unix.O_DIRECTORY|unix.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	return setFileAttrs(dirfd, file, mode, metadata, options, false)
+	return setFileAttrs(resolver, dirfd, file, mode, metadata, options, false, policy)
 }
 
-func safeLink(dirfd int, mode os.FileMode, metadata *fileMetadata, options *archive.TarOptions) error {
-	sourceFile, err := openFileUnderRoot(dirfd, metadata.Linkname, unix.O_PATH|unix.O_RDONLY|unix.O_NOFOLLOW, 0)
+func safeLink(resolver *PathResolver, dirfd int, mode os.FileMode, metadata *fileMetadata, options *archive.TarOptions, policy ErrorPolicy) error {
+	sourceFile, err := resolver.openFileUnderRoot(dirfd, metadata.Linkname, unix.O_PATH|unix.O_RDONLY|unix.O_NOFOLLOW, 0)
 	if err != nil {
 		return err
 	}
@@ -415,7 +354,7 @@ func safeLink(dirfd int, mode os.FileMode, metadata *fileMetadata, options *arch
 	destDir, destBase := filepath.Split(metadata.Name)
 	destDirFd := dirfd
 	if destDir != "" && destDir != "." {
-		f, err := openOrCreateDirUnderRoot(dirfd, destDir, 0)
+		f, err := resolver.openOrCreateDirUnderRoot(dirfd, destDir, 0)
 		if err != nil {
 			return err
 		}
@@ -423,35 +362,38 @@ func safeLink(dirfd int, mode os.FileMode, metadata *fileMetadata, options *arch
 		destDirFd = int(f.Fd())
 	}
 
-	err = doHardLink(int(sourceFile.Fd()), destDirFd, destBase)
-	if err != nil {
-		return fmt.Errorf("create hardlink %q pointing to %q: %w", metadata.Name, metadata.Linkname, err)
+	if err := doHardLink(int(sourceFile.Fd()), destDirFd, destBase); err != nil {
+		wrapped := fmt.Errorf("create hardlink %q pointing to %q: %w", metadata.Name, metadata.Linkname, err)
+		if consultErrorPolicy(policy, metadata, wrapped) == ErrorActionAbort {
+			return wrapped
+		}
+		return nil
 	}
 
-	newFile, err := openFileUnderRoot(dirfd, metadata.Name, unix.O_WRONLY|unix.O_NOFOLLOW, 0)
+	newFile, err := resolver.openFileUnderRoot(dirfd, metadata.Name, unix.O_WRONLY|unix.O_NOFOLLOW, 0)
 	if err != nil {
 		// If the target is a symlink, open the file with O_PATH.
 		if errors.Is(err, unix.ELOOP) {
-			newFile, err := openFileUnderRoot(dirfd, metadata.Name, unix.O_PATH|unix.O_NOFOLLOW, 0)
+			newFile, err := resolver.openFileUnderRoot(dirfd, metadata.Name, unix.O_PATH|unix.O_NOFOLLOW, 0)
 			if err != nil {
 				return err
 			}
 			defer newFile.Close()
 
-			return setFileAttrs(dirfd, newFile, mode, metadata, options, true)
+			return setFileAttrs(resolver, dirfd, newFile, mode, metadata, options, true, policy)
 		}
 		return err
 	}
 	defer newFile.Close()
 
-	return setFileAttrs(dirfd, newFile, mode, metadata, options, false)
+	return setFileAttrs(resolver, dirfd, newFile, mode, metadata, options, false, policy)
 }
 
-func safeSymlink(dirfd int, mode os.FileMode, metadata *fileMetadata, options *archive.TarOptions) error {
+func safeSymlink(resolver *PathResolver, dirfd int, mode os.FileMode, metadata *fileMetadata, options *archive.TarOptions) error {
 	destDir, destBase := filepath.Split(metadata.Name)
 	destDirFd := dirfd
 	if destDir != "" && destDir != "." {
-		f, err := openOrCreateDirUnderRoot(dirfd, destDir, 0)
+		f, err := resolver.openOrCreateDirUnderRoot(dirfd, destDir, 0)
 		if err != nil {
 			return err
 		}
@@ -466,12 +408,20 @@ func safeSymlink(dirfd int, mode os.FileMode, metadata *fileMetadata, options *a
 }
 
 type whiteoutHandler struct {
-	Dirfd int
-	Root  string
+	Dirfd    int
+	Root     string
+	Resolver *PathResolver
+}
+
+func (d whiteoutHandler) resolver() *PathResolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return defaultPathResolver
 }
 
 func (d whiteoutHandler) Setxattr(path, name string, value []byte) error {
-	file, err := openOrCreateDirUnderRoot(d.Dirfd, path, 0)
+	file, err := d.resolver().openOrCreateDirUnderRoot(d.Dirfd, path, 0)
 	if err != nil {
 		return err
 	}
@@ -487,7 +437,7 @@ func (d whiteoutHandler) Mknod(path string, mode uint32, dev int) error {
 	dir, base := filepath.Split(path)
 	dirfd := d.Dirfd
 	if dir != "" && dir != "." {
-		dir, err := openOrCreateDirUnderRoot(d.Dirfd, dir, 0)
+		dir, err := d.resolver().openOrCreateDirUnderRoot(d.Dirfd, dir, 0)
 		if err != nil {
 			return err
 		}
@@ -511,7 +461,7 @@ func checkChownErr(err error, name string, uid, gid int) error {
 }
 
 func (d whiteoutHandler) Chown(path string, uid, gid int) error {
-	file, err := openFileUnderRoot(d.Dirfd, path, unix.O_PATH, 0)
+	file, err := d.resolver().openFileUnderRoot(d.Dirfd, path, unix.O_PATH, 0)
 	if err != nil {
 		return err
 	}
@@ -537,19 +487,41 @@ type readerAtCloser interface {
 // seekableFile is a struct that wraps an *os.File to provide an ImageSourceSeekable.
 type seekableFile struct {
 	reader readerAtCloser
+	opts   SeekableOptions
 }
 
 func (f *seekableFile) Close() error {
 	return f.reader.Close()
 }
 
+// GetBlobAt returns a section reader per requested chunk, each wrapped with
+// the decompressor its magic bytes indicate (see [CompressionDetector]):
+// callers always see plaintext, regardless of whether the underlying chunk
+// range is a raw, gzip, or zstd-compressed self-contained unit of the blob.
 func (f *seekableFile) GetBlobAt(chunks []ImageSourceChunk) (chan io.ReadCloser, chan error, error) {
 	streams := make(chan io.ReadCloser)
 	errs := make(chan error)
 
+	detector := f.opts.Detector
+	if detector == nil {
+		detector = DefaultCompressionDetector
+	}
+
 	go func() {
 		for _, chunk := range chunks {
-			streams <- io.NopCloser(io.NewSectionReader(f.reader, int64(chunk.Offset), int64(chunk.Length)))
+			raw := io.NopCloser(io.NewSectionReader(f.reader, int64(chunk.Offset), int64(chunk.Length)))
+			stream, err := detector.decompress(raw)
+			if err != nil {
+				// Close streams before sending the error: callers drain
+				// streams with `for range streams` before ever looking at
+				// errs, so sending on errs first, with streams still open,
+				// deadlocks them against this goroutine.
+				close(streams)
+				errs <- err
+				close(errs)
+				return
+			}
+			streams <- stream
 		}
 		close(streams)
 		close(errs)
@@ -558,6 +530,8 @@ func (f *seekableFile) GetBlobAt(chunks []ImageSourceChunk) (chan io.ReadCloser,
 	return streams, errs, nil
 }
 
-func newSeekableFile(reader readerAtCloser) *seekableFile {
-	return &seekableFile{reader: reader}
-}
\ No newline at end of file
+// newSeekableFile wraps reader as an ImageSourceSeekable, applying opts to
+// every chunk it subsequently serves through GetBlobAt.
+func newSeekableFile(reader readerAtCloser, opts SeekableOptions) *seekableFile {
+	return &seekableFile{reader: reader, opts: opts}
+}
@@ -0,0 +1,118 @@
+package chunked
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chunked/internal"
+)
+
+// newSetFileAttrsFixture creates a regular file with a forced attribute
+// failure (an xattr value that isn't valid base64, so the failure is
+// deterministic regardless of the privileges the test runs with) and
+// returns the open *os.File and the metadata describing it. The chown
+// step is a no-op (current uid/gid), so it never fails and the forced
+// failure is reached.
+func newSetFileAttrsFixture(t *testing.T) (*os.File, *fileMetadata) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	modTime := time.Unix(1000000000, 0)
+	metadata := &fileMetadata{
+		FileMetadata: internal.FileMetadata{
+			Type:       internal.TypeReg,
+			Name:       "file",
+			UID:        os.Geteuid(),
+			GID:        os.Getegid(),
+			ModTime:    &modTime,
+			AccessTime: &modTime,
+			Xattrs:     map[string]string{"user.bad": "not valid base64!!"},
+		},
+	}
+	return f, metadata
+}
+
+// TestSetFileAttrsSkipAbandonsRestOfEntry confirms that an ErrorPolicy
+// returning ErrorActionSkip for a failing attribute leaves every
+// attribute applied after it (here, mtime and mode) untouched.
+func TestSetFileAttrsSkipAbandonsRestOfEntry(t *testing.T) {
+	f, metadata := newSetFileAttrsFixture(t)
+
+	const targetMode = 0o600
+	policy := func(entry *internal.FileMetadata, err error) ErrorAction { return ErrorActionSkip }
+
+	if err := setFileAttrs(&PathResolver{}, 0, f, targetMode, metadata, &archive.TarOptions{}, false, policy); err != nil {
+		t.Fatalf("setFileAttrs: %v", err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() == targetMode {
+		t.Error("mode was applied despite ErrorActionSkip on an earlier attribute")
+	}
+	if st.ModTime().Equal(*metadata.ModTime) {
+		t.Error("mtime was applied despite ErrorActionSkip on an earlier attribute")
+	}
+}
+
+// TestSetFileAttrsRetryWithoutAttrKeepsGoing confirms that an ErrorPolicy
+// returning ErrorActionRetryWithoutAttr for a failing attribute still
+// applies the attributes that come after it.
+func TestSetFileAttrsRetryWithoutAttrKeepsGoing(t *testing.T) {
+	f, metadata := newSetFileAttrsFixture(t)
+
+	const targetMode = 0o600
+	policy := func(entry *internal.FileMetadata, err error) ErrorAction { return ErrorActionRetryWithoutAttr }
+
+	if err := setFileAttrs(&PathResolver{}, 0, f, targetMode, metadata, &archive.TarOptions{}, false, policy); err != nil {
+		t.Fatalf("setFileAttrs: %v", err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != targetMode {
+		t.Errorf("mode = %o, want %o: ErrorActionRetryWithoutAttr should not block later attributes", st.Mode().Perm(), os.FileMode(targetMode))
+	}
+	if !st.ModTime().Equal(*metadata.ModTime) {
+		t.Errorf("mtime = %v, want %v: ErrorActionRetryWithoutAttr should not block later attributes", st.ModTime(), *metadata.ModTime)
+	}
+}
+
+// TestSetFileAttrsAbortStopsImmediately confirms that an ErrorPolicy
+// returning ErrorActionAbort surfaces the wrapped error and leaves later
+// attributes unapplied.
+func TestSetFileAttrsAbortStopsImmediately(t *testing.T) {
+	f, metadata := newSetFileAttrsFixture(t)
+
+	const targetMode = 0o600
+	policy := func(entry *internal.FileMetadata, err error) ErrorAction { return ErrorActionAbort }
+
+	err := setFileAttrs(&PathResolver{}, 0, f, targetMode, metadata, &archive.TarOptions{}, false, policy)
+	if err == nil {
+		t.Fatal("setFileAttrs: expected an error from ErrorActionAbort, got nil")
+	}
+
+	st, statErr := f.Stat()
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if st.Mode().Perm() == targetMode {
+		t.Error("mode was applied despite ErrorActionAbort")
+	}
+}
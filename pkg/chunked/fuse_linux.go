@@ -0,0 +1,438 @@
+package chunked
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containers/storage/pkg/chunked/internal"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// Mount serves toc through a read-only FUSE filesystem instead of
+// extracting it to disk the way copyFileContent does. It returns the
+// mountpoint (a freshly created temporary directory) and an unmount
+// function the caller must invoke to tear the filesystem down and remove
+// the mountpoint, whether or not the mount was ever used.
+//
+// File metadata (mode, uid, gid, xattrs, times) is served directly out of
+// toc, held in memory for the lifetime of the mount. Regular file content
+// is not fetched until a read actually touches it: the covering chunk is
+// requested from source with GetBlobAt, verified against the chunk's
+// digest in toc, and - if store is non-nil - cached there so a repeat
+// read, or a later eager extraction of another layer sharing the same
+// chunk, doesn't go back to source.
+//
+// dirfd is not used: the mountpoint is always a new directory under the
+// system's default temporary directory, wherever dirfd points.
+func Mount(dirfd int, toc *internal.TOC, source ImageSourceSeekable, store ChunkStore) (mountpoint string, unmount func() error, err error) {
+	if toc == nil {
+		return "", nil, fmt.Errorf("mount chunked layer: nil TOC")
+	}
+	if source == nil {
+		return "", nil, fmt.Errorf("mount chunked layer: nil image source")
+	}
+
+	mountpoint, err = os.MkdirTemp("", "chunked-fuse-")
+	if err != nil {
+		return "", nil, fmt.Errorf("create FUSE mountpoint: %w", err)
+	}
+
+	root := &fuseRoot{toc: toc, source: source, store: store}
+	server, err := fs.Mount(mountpoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			Name:     "chunked",
+			ReadOnly: true,
+		},
+	})
+	if err != nil {
+		os.Remove(mountpoint)
+		return "", nil, fmt.Errorf("mount chunked layer at %q: %w", mountpoint, err)
+	}
+
+	unmount = func() error {
+		if err := server.Unmount(); err != nil {
+			return fmt.Errorf("unmount chunked layer at %q: %w", mountpoint, err)
+		}
+		return os.Remove(mountpoint)
+	}
+	return mountpoint, unmount, nil
+}
+
+// fuseRoot is the root inode of a mounted layer. Its only job is to build
+// the rest of the tree, on mount, from the flat entry list in the TOC.
+type fuseRoot struct {
+	fs.Inode
+
+	toc    *internal.TOC
+	source ImageSourceSeekable
+	store  ChunkStore
+}
+
+var _ fs.NodeOnAdder = (*fuseRoot)(nil)
+
+// OnAdd builds the whole directory tree up front: TOC entries are a flat
+// list in arbitrary order, so directories are created lazily (and
+// memoized) as each entry's path is resolved, rather than requiring
+// parents to be listed before their children.
+func (r *fuseRoot) OnAdd(ctx context.Context) {
+	dirs := map[string]*fs.Inode{"": &r.Inode}
+
+	// Indexed up front so a TypeLink entry can resolve its target's
+	// FileMetadata (and therefore chunk list) regardless of which of the
+	// two appears first in the TOC's arbitrary entry order.
+	byName := make(map[string]*internal.FileMetadata, len(r.toc.Entries))
+	for i := range r.toc.Entries {
+		entry := &r.toc.Entries[i]
+		if entry.Type != internal.TypeChunk {
+			byName[entry.Name] = entry
+		}
+	}
+
+	for i := range r.toc.Entries {
+		entry := &r.toc.Entries[i]
+		if entry.Type == internal.TypeChunk {
+			// Chunk entries aren't files of their own; they describe a byte
+			// range of the regular file that shares their Name, and are
+			// consulted directly out of the TOC by fuseFile.Read.
+			continue
+		}
+
+		name := strings.Trim(filepath.Clean("/"+entry.Name), "/")
+		dir, base := filepath.Split(name)
+		parent := ensureDirInode(ctx, dirs, strings.Trim(dir, "/"))
+
+		var child *fs.Inode
+		switch entry.Type {
+		case internal.TypeDir:
+			if existing, ok := dirs[name]; ok {
+				// Already synthesized for an earlier entry beneath it: attach
+				// this entry's metadata rather than replacing the inode and
+				// losing the children already added to it.
+				if d, ok := existing.Operations().(*fuseDir); ok {
+					d.entry = entry
+				}
+				continue
+			}
+			child = parent.NewPersistentInode(ctx, &fuseDir{entry: entry}, fs.StableAttr{Mode: syscall.S_IFDIR})
+			dirs[name] = child
+		case internal.TypeSymlink:
+			child = parent.NewPersistentInode(ctx, &fuseFile{entry: entry}, fs.StableAttr{Mode: syscall.S_IFLNK})
+		case internal.TypeLink:
+			// A hard link shares its target's TOC entry, and therefore its
+			// content and chunk list, but gets its own directory entry
+			// here. Fall back to the link's own (empty) entry if its
+			// target is somehow missing from the TOC.
+			target := entry
+			if t, ok := byName[entry.Linkname]; ok {
+				target = t
+			}
+			child = parent.NewPersistentInode(ctx, &fuseFile{entry: target, root: r}, fs.StableAttr{Mode: syscall.S_IFREG})
+		default:
+			// Regular files.
+			child = parent.NewPersistentInode(ctx, &fuseFile{entry: entry, root: r}, fs.StableAttr{Mode: syscall.S_IFREG})
+		}
+		parent.AddChild(base, child, true)
+	}
+}
+
+// ensureDirInode returns the inode for dir, which may be synthetic (no
+// TypeDir entry of its own appeared in the TOC), creating it and any
+// missing ancestors first.
+func ensureDirInode(ctx context.Context, dirs map[string]*fs.Inode, dir string) *fs.Inode {
+	if n, ok := dirs[dir]; ok {
+		return n
+	}
+
+	parentDir, base := filepath.Split(dir)
+	parent := ensureDirInode(ctx, dirs, strings.Trim(parentDir, "/"))
+
+	// No TOC entry of its own, so it gets go-fuse's default attributes;
+	// see fuseDir.Getattr.
+	child := parent.NewPersistentInode(ctx, &fuseDir{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+	parent.AddChild(base, child, true)
+	dirs[dir] = child
+	return child
+}
+
+// fuseDir is the inode for a directory served out of a mounted TOC. entry
+// is nil for directories synthesized because a deeper entry's path implied
+// them without a TypeDir entry of their own appearing in the TOC, which
+// fall back to go-fuse's default attributes.
+type fuseDir struct {
+	fs.Inode
+
+	entry *internal.FileMetadata
+}
+
+var (
+	_ fs.NodeGetattrer  = (*fuseDir)(nil)
+	_ fs.NodeGetxattrer = (*fuseDir)(nil)
+)
+
+func (d *fuseDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if d.entry == nil {
+		return 0
+	}
+	out.Mode = syscall.S_IFDIR | uint32(d.entry.Mode)
+	out.Uid = uint32(d.entry.UID)
+	out.Gid = uint32(d.entry.GID)
+	if mt := d.entry.ModTime; mt != nil {
+		out.SetTimes(nil, mt, mt)
+	}
+	return 0
+}
+
+func (d *fuseDir) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if d.entry == nil {
+		return 0, syscall.ENODATA
+	}
+	enc, ok := d.entry.Xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	// TOC xattr values are base64-encoded.
+	val, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if len(dest) < len(val) {
+		return uint32(len(val)), syscall.ERANGE
+	}
+	return uint32(copy(dest, val)), 0
+}
+
+// fuseFile is the inode for a regular file, hard link, or symlink served
+// out of a mounted TOC. root is nil for symlinks, which are served
+// straight out of entry.Linkname without ever touching the image source.
+type fuseFile struct {
+	fs.Inode
+
+	entry *internal.FileMetadata
+	root  *fuseRoot
+
+	mu     sync.Mutex
+	chunks []*internal.FileMetadata // this file's TypeChunk entries, indexed lazily
+}
+
+var (
+	_ fs.NodeGetattrer  = (*fuseFile)(nil)
+	_ fs.NodeReader     = (*fuseFile)(nil)
+	_ fs.NodeReadlinker = (*fuseFile)(nil)
+	_ fs.NodeGetxattrer = (*fuseFile)(nil)
+)
+
+func (f *fuseFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuseFileTypeBits(f.entry.Type) | uint32(f.entry.Mode)
+	out.Size = uint64(f.entry.Size)
+	out.Uid = uint32(f.entry.UID)
+	out.Gid = uint32(f.entry.GID)
+	if mt := f.entry.ModTime; mt != nil {
+		out.SetTimes(nil, mt, mt)
+	}
+	return 0
+}
+
+func (f *fuseFile) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	enc, ok := f.entry.Xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	// TOC xattr values are base64-encoded.
+	val, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if len(dest) < len(val) {
+		return uint32(len(val)), syscall.ERANGE
+	}
+	return uint32(copy(dest, val)), 0
+}
+
+func (f *fuseFile) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(f.entry.Linkname), 0
+}
+
+// fuseFileTypeBits returns the S_IFMT bits Getattr must OR into out.Mode:
+// entry.Mode, like tar.Header.Mode, is permission/setuid/setgid/sticky bits
+// only and carries no file-type bits of its own.
+func fuseFileTypeBits(entryType string) uint32 {
+	if entryType == internal.TypeSymlink {
+		return syscall.S_IFLNK
+	}
+	return syscall.S_IFREG
+}
+
+// Read serves [off, off+len(dest)) of the file, fetching and verifying
+// only the TOC chunks that cover the requested range.
+func (f *fuseFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	if f.chunks == nil {
+		f.chunks = f.chunksCoveringFile()
+	}
+	chunks := f.chunks
+	f.mu.Unlock()
+
+	n, err := f.readAt(dest, off, chunks)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// chunksCoveringFile finds this file's TypeChunk entries in the TOC. This
+// is only expensive the first time a given file is read.
+func (f *fuseFile) chunksCoveringFile() []*internal.FileMetadata {
+	var chunks []*internal.FileMetadata
+	for i := range f.root.toc.Entries {
+		c := &f.root.toc.Entries[i]
+		if c.Type == internal.TypeChunk && c.Name == f.entry.Name {
+			chunks = append(chunks, c)
+		}
+	}
+	if len(chunks) == 0 {
+		// Not a chunked file: treat the whole file as a single chunk keyed
+		// by its own digest.
+		chunks = []*internal.FileMetadata{f.entry}
+	}
+	return chunks
+}
+
+func (f *fuseFile) readAt(dest []byte, off int64, chunks []*internal.FileMetadata) (int, error) {
+	readStart, readEnd := off, off+int64(len(dest))
+
+	var total int
+	for _, c := range chunks {
+		size := c.ChunkSize
+		if size == 0 {
+			// A non-chunked file's own entry covers the whole file.
+			size = c.Size
+		}
+		chunkStart, chunkEnd := c.ChunkOffset, c.ChunkOffset+size
+		if readStart >= chunkEnd || readEnd <= chunkStart {
+			continue
+		}
+
+		content, err := f.fetchChunk(c)
+		if err != nil {
+			return total, err
+		}
+
+		lo, hi := readStart-chunkStart, readEnd-chunkStart
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > int64(len(content)) {
+			hi = int64(len(content))
+		}
+		total += copy(dest[chunkStart+lo-off:], content[lo:hi])
+	}
+	return total, nil
+}
+
+// fetchChunk returns the verified content of c, from root.store if already
+// cached there, or from root.source (populating root.store on success)
+// otherwise.
+func (f *fuseFile) fetchChunk(c *internal.FileMetadata) ([]byte, error) {
+	chunkDigest := c.ChunkDigest
+	if chunkDigest == "" {
+		chunkDigest = c.Digest
+	}
+
+	if f.root.store != nil && chunkDigest != "" {
+		if content, err := readChunkFromStore(f.root.store, chunkDigest); err == nil {
+			return content, nil
+		}
+	}
+
+	// ChunkOffset is the chunk's position within the file; its bytes in the
+	// blob are [Offset, EndOffset).
+	streams, errs, err := f.root.source.GetBlobAt([]ImageSourceChunk{{Offset: uint64(c.Offset), Length: uint64(c.EndOffset - c.Offset)}})
+	if err != nil {
+		return nil, fmt.Errorf("fetch chunk %q for %q: %w", chunkDigest, f.entry.Name, err)
+	}
+
+	var content []byte
+	for stream := range streams {
+		content, err = io.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read chunk %q for %q: %w", chunkDigest, f.entry.Name, err)
+		}
+	}
+	if err := <-errs; err != nil {
+		return nil, fmt.Errorf("fetch chunk %q for %q: %w", chunkDigest, f.entry.Name, err)
+	}
+
+	if chunkDigest != "" {
+		if err := verifyDigest(chunkDigest, content); err != nil {
+			return nil, fmt.Errorf("chunk for %q: %w", f.entry.Name, err)
+		}
+		if f.root.store != nil {
+			insertChunkIntoStore(f.root.store, chunkDigest, content)
+		}
+	}
+
+	return content, nil
+}
+
+// verifyDigest reports an error if content does not hash to d. d is
+// validated as a well-formed OCI digest before anything else touches it:
+// digest.Digest.Verifier panics on a digest with no algorithm separator,
+// and d is taken verbatim from a TOC entry, so a malformed one must not be
+// able to crash the mount.
+func verifyDigest(d string, content []byte) error {
+	if err := digest.Digest(d).Validate(); err != nil {
+		return fmt.Errorf("invalid chunk digest %q: %w", d, err)
+	}
+
+	verifier := digest.Digest(d).Verifier()
+	if _, err := verifier.Write(content); err != nil {
+		return fmt.Errorf("verify digest %q: %w", d, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%w: got content for digest %q", ErrChunkDigestMismatch, d)
+	}
+	return nil
+}
+
+// readChunkFromStore reads the entirety of the chunk stored under digest in
+// store into memory.
+func readChunkFromStore(store ChunkStore, digest string) ([]byte, error) {
+	fd, size, err := store.Lookup(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer unixClose(fd)
+
+	buf := make([]byte, size)
+	if _, err := unix.Pread(fd, buf, 0); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// insertChunkIntoStore best-effort adds content to store under digest.
+// Failures don't affect the read that is already being served from memory.
+func insertChunkIntoStore(store ChunkStore, digest string, content []byte) {
+	tmp, err := os.CreateTemp("", "chunked-fuse-chunk-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(content); err != nil {
+		return
+	}
+	_ = store.Insert(digest, int(tmp.Fd()))
+}
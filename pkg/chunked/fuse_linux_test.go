@@ -0,0 +1,32 @@
+package chunked
+
+import "testing"
+
+// TestVerifyDigestRejectsMalformedDigestWithoutPanicking is a regression
+// test: digest.Digest.Verifier panics on a digest with no ":" separator,
+// and d is attacker-controlled (it comes straight off TOC content pulled
+// from a registry).
+func TestVerifyDigestRejectsMalformedDigestWithoutPanicking(t *testing.T) {
+	for _, d := range []string{"", "not-a-digest", "sha256:"} {
+		if err := verifyDigest(d, []byte("content")); err == nil {
+			t.Errorf("verifyDigest(%q, ...): expected an error, got nil", d)
+		}
+	}
+}
+
+func TestVerifyDigestAcceptsMatchingContent(t *testing.T) {
+	content := []byte("hello world")
+	const digest = "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	if err := verifyDigest(digest, content); err != nil {
+		t.Fatalf("verifyDigest: %v", err)
+	}
+}
+
+func TestVerifyDigestRejectsMismatchedContent(t *testing.T) {
+	const digest = "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	if err := verifyDigest(digest, []byte("wrong content")); err == nil {
+		t.Fatal("verifyDigest: expected a mismatch error, got nil")
+	}
+}
@@ -0,0 +1,84 @@
+package chunked
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestPathResolverFallbackOpensRegularFile is a regression test for
+// PathResolverFallback: the userspace securejoin-based path must open a
+// plain file under the root just as openat2(2) would.
+func TestPathResolverFallbackOpensRegularFile(t *testing.T) {
+	dir := t.TempDir()
+	const content = "hello world"
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootFd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(rootFd)
+
+	r := &PathResolver{Mode: PathResolverFallback}
+	f, err := r.openFileUnderRoot(rootFd, "file", unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("openFileUnderRoot: %v", err)
+	}
+	defer f.Close()
+
+	got, err := os.ReadFile(procPathForFile(f))
+	if err != nil {
+		t.Fatalf("read opened file: %v", err)
+	}
+	if string(got) != content {
+		t.Fatalf("got %q, want %q", got, content)
+	}
+}
+
+// TestPathResolverFallbackRejectsSymlinkWithONoFollow exercises the
+// O_NOFOLLOW branch of openFileUnderRootFallback: it resolves only the
+// parent directory through securejoin and opens the last component
+// directly, so a symlink as the final path component must be rejected
+// rather than silently followed.
+func TestPathResolverFallbackRejectsSymlinkWithONoFollow(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "target"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rootFd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(rootFd)
+
+	r := &PathResolver{Mode: PathResolverFallback}
+	if _, err := r.openFileUnderRoot(rootFd, "link", unix.O_RDONLY|unix.O_NOFOLLOW, 0); err == nil {
+		t.Fatal("openFileUnderRoot: expected an error opening a symlink with O_NOFOLLOW, got nil")
+	}
+}
+
+// TestResolveFlagsPassesCustomResolveMask confirms that a non-zero Resolve
+// mask set on PathResolver is the value openFileUnderRootOpenat2 hands to
+// openat2(2)'s OpenHow.Resolve, rather than being silently replaced by
+// defaultResolveFlags.
+func TestResolveFlagsPassesCustomResolveMask(t *testing.T) {
+	r := &PathResolver{}
+	if got := r.resolveFlags(); got != defaultResolveFlags {
+		t.Fatalf("zero-value Resolve: got %#x, want default %#x", got, defaultResolveFlags)
+	}
+
+	custom := uint64(unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS)
+	r.Resolve = custom
+	if got := r.resolveFlags(); got != custom {
+		t.Fatalf("custom Resolve: got %#x, want %#x", got, custom)
+	}
+}
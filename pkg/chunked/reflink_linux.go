@@ -0,0 +1,66 @@
+package chunked
+
+import (
+	"os"
+
+	driversCopy "github.com/containers/storage/drivers/copy"
+	"golang.org/x/sys/unix"
+)
+
+func unixClose(fd int) {
+	unix.Close(fd)
+}
+
+// reflinkOrCopy materializes the content of srcFd into a new file named
+// destBase under destDirFd, preferring a copy-on-write reflink
+// (ioctl(FICLONERANGE)), then falling back to a hard link, then to
+// copy_file_range(2)/read+write via driversCopy.
+func reflinkOrCopy(srcFd, destDirFd int, destBase string, size int64) error {
+	st, err := os.Stat(procPathForFd(srcFd))
+	if err != nil {
+		return err
+	}
+
+	if err := reflinkInto(destDirFd, destBase, srcFd); err == nil {
+		return nil
+	}
+
+	if err := doHardLink(srcFd, destDirFd, destBase); err == nil {
+		return nil
+	}
+
+	// Neither reflink nor hard link worked (e.g. srcFd is on a different
+	// device): destBase is guaranteed not to exist at this point (reflinkInto
+	// only ever materializes it atomically on success, and doHardLink never
+	// leaves a dangling unlink behind without also failing), so it's safe to
+	// create it fresh for the copy fallback.
+	destFd, err := unix.Openat(destDirFd, destBase, unix.O_CREAT|unix.O_WRONLY|unix.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	destFile := os.NewFile(uintptr(destFd), destBase)
+	defer destFile.Close()
+
+	copyWithFileRange, copyWithFileClone := true, false
+	return driversCopy.CopyRegularToFile(procPathForFd(srcFd), destFile, st, &copyWithFileRange, &copyWithFileClone)
+}
+
+// reflinkInto attempts to materialize destBase under destDirFd as a
+// copy-on-write clone of srcFd. It works through a temporary name so that a
+// failed clone attempt never leaves a truncated destBase behind for the
+// hard-link or copy fallbacks to trip over.
+func reflinkInto(destDirFd int, destBase string, srcFd int) error {
+	tmpName := destBase + ".reflink-tmp"
+	destFd, err := unix.Openat(destDirFd, tmpName, unix.O_CREAT|unix.O_WRONLY|unix.O_TRUNC|unix.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(destFd)
+
+	if err := unix.IoctlFileClone(destFd, srcFd); err != nil {
+		unix.Unlinkat(destDirFd, tmpName, 0)
+		return err
+	}
+
+	return unix.Renameat(destDirFd, tmpName, destDirFd, destBase)
+}
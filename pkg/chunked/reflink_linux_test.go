@@ -0,0 +1,47 @@
+package chunked
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestReflinkOrCopyMaterializesDestination is a regression test for
+// reflinkOrCopy leaving destBase unlinked-but-reported-successful when the
+// hard-link fallback unlinks an already-created destBase and then itself
+// fails: the destination must exist with the right content however the
+// function gets there (reflink, hard link, or copy_file_range).
+func TestReflinkOrCopyMaterializesDestination(t *testing.T) {
+	dir := t.TempDir()
+	const content = "hello world"
+
+	srcPath := filepath.Join(dir, "src")
+	if err := os.WriteFile(srcPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcFile.Close()
+
+	destDirFd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(destDirFd)
+
+	if err := reflinkOrCopy(int(srcFile.Fd()), destDirFd, "dest", int64(len(content))); err != nil {
+		t.Fatalf("reflinkOrCopy: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatalf("destination file missing after reflinkOrCopy: %v", err)
+	}
+	if string(got) != content {
+		t.Fatalf("got %q, want %q", got, content)
+	}
+}
@@ -0,0 +1,239 @@
+package chunked
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	godigest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// OnDiskChunkStore is a [ChunkStore] backed by a directory tree on the local
+// filesystem.  Chunks are sharded by the first four hex characters of their
+// digest, so a single directory never holds more than a small fraction of
+// the store's entries.  Once the total size of the store exceeds MaxSize,
+// the least-recently-looked-up chunks are evicted to make room, using the
+// chunk files' atimes as the recency signal.
+type OnDiskChunkStore struct {
+	// root is the directory the store is rooted at.  It is created if it
+	// does not already exist.
+	root string
+
+	// maxSize is the maximum total size, in bytes, the store is allowed
+	// to grow to before it starts evicting entries.  A value <= 0 means
+	// the store never evicts.
+	maxSize int64
+
+	mu        sync.Mutex
+	totalSize int64
+}
+
+// NewOnDiskChunkStore creates, or reopens, a chunk store rooted at root. If
+// root already contains chunks from a previous run, they are counted
+// against maxSize immediately rather than being forgotten.
+func NewOnDiskChunkStore(root string, maxSize int64) (*OnDiskChunkStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("create chunk store directory %q: %w", root, err)
+	}
+
+	s := &OnDiskChunkStore{
+		root:    root,
+		maxSize: maxSize,
+	}
+
+	entries, err := s.listEntries()
+	if err != nil {
+		return nil, fmt.Errorf("scan chunk store directory %q: %w", root, err)
+	}
+	for _, e := range entries {
+		s.totalSize += e.size
+	}
+	return s, nil
+}
+
+// shardedPath returns the on-disk path a chunk with the given digest is, or
+// would be, stored at. digest is attacker-controlled TOC data, so it is
+// validated as a well-formed OCI digest before being turned into path
+// components: without that, a crafted digest containing "/" or ".." could
+// escape s.root entirely.
+func (s *OnDiskChunkStore) shardedPath(digest string) (string, error) {
+	d := godigest.Digest(digest)
+	if err := d.Validate(); err != nil {
+		return "", fmt.Errorf("chunk store: invalid digest %q: %w", digest, err)
+	}
+	// Shard on the hex-encoded hash itself, not the algorithm prefix every
+	// digest using the same algorithm shares, so chunks actually spread
+	// across shard directories instead of all landing in the same one.
+	encoded := d.Encoded()
+	name := strings.ReplaceAll(digest, ":", "_")
+	return filepath.Join(s.root, encoded[:2], encoded[2:4], name), nil
+}
+
+// Lookup implements [ChunkStore].
+func (s *OnDiskChunkStore) Lookup(digest string) (int, int64, error) {
+	path, err := s.shardedPath(digest)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	fd, err := unix.Open(path, unix.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return -1, 0, os.ErrNotExist
+		}
+		return -1, 0, fmt.Errorf("open chunk %q: %w", digest, err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return -1, 0, fmt.Errorf("stat chunk %q: %w", digest, err)
+	}
+
+	// Best-effort: record this lookup so the chunk isn't picked as the
+	// eviction candidate just because it hasn't been *inserted* recently.
+	now := []unix.Timespec{{Nsec: unix.UTIME_NOW}, {Nsec: unix.UTIME_NOW}}
+	_ = unix.UtimesNanoAt(unix.AT_FDCWD, path, now, 0)
+
+	return fd, st.Size, nil
+}
+
+// Insert implements [ChunkStore].
+func (s *OnDiskChunkStore) Insert(digest string, fd int) error {
+	path, err := s.shardedPath(digest)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		// Already present; nothing to do.
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create chunk store shard %q: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-chunk-*")
+	if err != nil {
+		return fmt.Errorf("create temporary file for chunk %q: %w", digest, err)
+	}
+	removeTmp := true
+	defer func() {
+		if removeTmp {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	size, err := copyFdToFile(fd, tmp)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("write chunk %q: %w", digest, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("install chunk %q: %w", digest, err)
+	}
+	removeTmp = false
+
+	s.totalSize += size
+	s.evictLocked()
+	return nil
+}
+
+// copyFdToFile copies the content available at fd, from offset 0, into dst
+// without disturbing fd's file offset, since the caller retains ownership
+// of fd and may still be using it.
+func copyFdToFile(fd int, dst *os.File) (int64, error) {
+	buf := make([]byte, 256*1024)
+	var off, total int64
+	for {
+		n, err := unix.Pread(fd, buf, off)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			off += int64(n)
+			total += int64(n)
+		}
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+	}
+}
+
+type chunkStoreEntry struct {
+	path  string
+	size  int64
+	atime unix.Timespec
+}
+
+// listEntries walks the store directory, returning every chunk file found.
+func (s *OnDiskChunkStore) listEntries() ([]chunkStoreEntry, error) {
+	var entries []chunkStoreEntry
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-chunk-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		atime := unix.Timespec{}
+		if ok {
+			atime = unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim))
+		}
+		entries = append(entries, chunkStoreEntry{path: path, size: info.Size(), atime: atime})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// evictLocked removes the least-recently-looked-up chunks until the store's
+// total size is at or below maxSize. s.mu must be held by the caller.
+func (s *OnDiskChunkStore) evictLocked() {
+	if s.maxSize <= 0 || s.totalSize <= s.maxSize {
+		return
+	}
+
+	entries, err := s.listEntries()
+	if err != nil {
+		// Can't evict safely without an accurate listing; try again next
+		// time Insert is called.
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].atime.Nano() < entries[j].atime.Nano()
+	})
+
+	for _, e := range entries {
+		if s.totalSize <= s.maxSize {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			continue
+		}
+		s.totalSize -= e.size
+	}
+}
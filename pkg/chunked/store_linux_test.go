@@ -0,0 +1,69 @@
+package chunked
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedPathRejectsMalformedDigest(t *testing.T) {
+	s, err := NewOnDiskChunkStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{
+		"",
+		"not-a-digest",
+		"sha256:../../../etc/passwd",
+		"sha256:/etc/passwd",
+	} {
+		if _, err := s.shardedPath(d); err == nil {
+			t.Errorf("shardedPath(%q): expected an error, got nil", d)
+		}
+	}
+}
+
+func TestShardedPathValidDigestStaysUnderRoot(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewOnDiskChunkStore(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	path, err := s.shardedPath(digest)
+	if err != nil {
+		t.Fatalf("shardedPath(%q): %v", digest, err)
+	}
+	if len(path) < len(root) || path[:len(root)] != root {
+		t.Fatalf("shardedPath(%q) = %q, want a path under %q", digest, path, root)
+	}
+}
+
+// TestShardedPathSpreadsAcrossShards is a regression test: shardedPath used
+// to shard on the "sha256_" prefix every same-algorithm digest shares
+// instead of the hash itself, so every chunk landed under the same two
+// shard directories regardless of content.
+func TestShardedPathSpreadsAcrossShards(t *testing.T) {
+	s, err := NewOnDiskChunkStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		digestA = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		digestB = "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	)
+	pathA, err := s.shardedPath(digestA)
+	if err != nil {
+		t.Fatalf("shardedPath(%q): %v", digestA, err)
+	}
+	pathB, err := s.shardedPath(digestB)
+	if err != nil {
+		t.Fatalf("shardedPath(%q): %v", digestB, err)
+	}
+
+	if filepath.Dir(pathA) == filepath.Dir(pathB) {
+		t.Fatalf("shardedPath(%q) and shardedPath(%q) landed in the same shard directory %q", digestA, digestB, filepath.Dir(pathA))
+	}
+}